@@ -0,0 +1,65 @@
+// Copyright 2014 Lieven Govaerts. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strings"
+)
+
+// grpcMessageHeaderLen is the length-prefixed message framing gRPC applies
+// to every message on top of HTTP/2 DATA frames: 1 byte compression flag,
+// 4 byte big-endian length, then the message payload.
+const grpcMessageHeaderLen = 5
+
+// isGRPCContentType reports whether a "content-type" header value marks an
+// HTTP/2 request or response as carrying gRPC framing.
+func isGRPCContentType(contentType string) bool {
+	return strings.HasPrefix(contentType, "application/grpc")
+}
+
+// grpcFramer reassembles the length-prefixed gRPC message stream carried in
+// a sequence of HTTP/2 DATA frames, for one direction of one RPC. Messages
+// may be split across DATA frames, and a unary call has exactly one message
+// while a streaming call has many, so frames are buffered until a complete
+// message header and payload are available.
+type grpcFramer struct {
+	buf          bytes.Buffer
+	messageCount int
+	byteSize     int64
+}
+
+// feed appends newly-arrived DATA frame bytes and extracts every complete
+// message now available. Payload bytes are only counted, never decoded,
+// since trmon has no registered .proto descriptor to interpret them with.
+func (g *grpcFramer) feed(data []byte) {
+	g.buf.Write(data)
+
+	for {
+		if g.buf.Len() < grpcMessageHeaderLen {
+			return
+		}
+		header := g.buf.Bytes()[:grpcMessageHeaderLen]
+		length := binary.BigEndian.Uint32(header[1:5])
+		if g.buf.Len() < grpcMessageHeaderLen+int(length) {
+			return
+		}
+
+		g.buf.Next(grpcMessageHeaderLen + int(length))
+		g.messageCount++
+		g.byteSize += int64(length)
+	}
+}
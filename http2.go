@@ -0,0 +1,362 @@
+// Copyright 2014 Lieven Govaerts. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/hpack"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// http2Preface is the client connection preface defined in RFC 7540 §3.5.
+const http2Preface = "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n"
+
+// h2Stream tracks the request or response currently being assembled for a
+// single HTTP/2 stream ID, in one direction of a bidirectional connection.
+type h2Stream struct {
+	streamID       uint32
+	header         http.Header
+	method         string
+	path           string
+	authority      string
+	scheme         string
+	status         string
+	body           bytes.Buffer
+	promised       bool
+	headersEmitted bool
+
+	// gRPC call accounting, populated once the headers identify the stream
+	// as carrying gRPC framing (see isGRPCContentType). Request-side
+	// framing is tracked in the BidiStream's shared h2RPCState instead of
+	// here, since runOutH2 and runInH2 each build their own h2Conn and
+	// never see each other's streams; see h2RPCState.
+	isGRPC      bool
+	respFrames  grpcFramer
+	grpcStatus  string
+	grpcMessage string
+}
+
+// h2RPCState carries the request-side facts a gRPC response needs once its
+// trailers arrive: the decoded :path (present only on the request HEADERS)
+// and the request DATA frame accounting. It's keyed by stream ID on the
+// shared BidiStream because runOutH2 and runInH2 run concurrently over
+// separate h2Conns, one per direction.
+type h2RPCState struct {
+	mu        sync.Mutex
+	path      string
+	reqFrames grpcFramer
+}
+
+// h2RPCState returns the shared gRPC accounting for streamID, creating it on
+// first use.
+func (bds *BidiStream) h2RPCState(streamID uint32) *h2RPCState {
+	bds.h2mu.Lock()
+	defer bds.h2mu.Unlock()
+	if bds.h2States == nil {
+		bds.h2States = make(map[uint32]*h2RPCState)
+	}
+	s := bds.h2States[streamID]
+	if s == nil {
+		s = &h2RPCState{}
+		bds.h2States[streamID] = s
+	}
+	return s
+}
+
+// h2Conn holds the persistent, per-direction state that RFC 7541 requires an
+// HPACK decoder to keep across frames: the dynamic table must survive for
+// the lifetime of the HTTP/2 connection, not just a single frame.
+type h2Conn struct {
+	hdec    *hpack.Decoder
+	streams map[uint32]*h2Stream
+}
+
+func newH2Conn() *h2Conn {
+	c := &h2Conn{streams: make(map[uint32]*h2Stream)}
+	c.hdec = hpack.NewDecoder(4096, nil)
+	return c
+}
+
+func (c *h2Conn) stream(id uint32) *h2Stream {
+	s := c.streams[id]
+	if s == nil {
+		s = &h2Stream{streamID: id, header: make(http.Header)}
+		c.streams[id] = s
+	}
+	return s
+}
+
+// looksLikeHTTP2Preface peeks at the front of buf and reports whether it
+// starts with the HTTP/2 client connection preface, without consuming any
+// bytes if the stream turns out not to be HTTP/2.
+func looksLikeHTTP2Preface(buf *bufio.Reader) bool {
+	b, err := buf.Peek(len(http2Preface))
+	if err != nil {
+		return false
+	}
+	return string(b) == http2Preface
+}
+
+// runOutH2 is a blocking function that reads HTTP/2 HEADERS/CONTINUATION/DATA
+// frames carrying requests from a client-to-server stream, demultiplexing
+// them by stream ID and forwarding each completed request into storage. buf
+// must already have the client preface pending at its front.
+func (h *TCPStream) runOutH2(bds *BidiStream, buf *bufio.Reader) {
+	// Consume the client preface before handing the reader to the framer.
+	if _, err := io.CopyN(ioutil.Discard, buf, int64(len(http2Preface))); err != nil {
+		log.Println("Error consuming HTTP/2 preface", h.netFlow, h.tcpFlow, ":", err)
+		return
+	}
+
+	conn := newH2Conn()
+	framer := http2.NewFramer(ioutil.Discard, buf)
+
+	for {
+		frame, err := framer.ReadFrame()
+		if err == io.EOF {
+			// ReassemblyComplete records the connection close timestamp.
+			return
+		} else if err != nil {
+			if h.closed {
+				// error occurred after stream was closed, ignore.
+			} else {
+				log.Println("Error reading HTTP/2 frame", h.netFlow, h.tcpFlow, ":", err)
+			}
+			return
+		}
+
+		switch f := frame.(type) {
+		case *http2.HeadersFrame:
+			s := conn.stream(f.StreamID)
+			decodeH2Headers(conn.hdec, f.HeaderBlockFragment(), s)
+			if f.HeadersEnded() {
+				h.emitH2Request(bds, s, f.StreamID)
+			}
+		case *http2.ContinuationFrame:
+			s := conn.stream(f.StreamID)
+			decodeH2Headers(conn.hdec, f.HeaderBlockFragment(), s)
+			if f.HeadersEnded() {
+				h.emitH2Request(bds, s, f.StreamID)
+			}
+		case *http2.DataFrame:
+			s := conn.stream(f.StreamID)
+			if s.isGRPC {
+				rpc := bds.h2RPCState(f.StreamID)
+				rpc.mu.Lock()
+				rpc.reqFrames.feed(f.Data())
+				rpc.mu.Unlock()
+			} else {
+				s.body.Write(f.Data())
+			}
+		case *http2.PushPromiseFrame:
+			// Create the synthetic request for the promised stream before its
+			// response HEADERS arrive.
+			s := conn.stream(f.PromiseID)
+			s.promised = true
+			decodeH2Headers(conn.hdec, f.HeaderBlockFragment(), s)
+			if f.HeadersEnded() {
+				h.emitH2Request(bds, s, f.PromiseID)
+			}
+		case *http2.SettingsFrame, *http2.WindowUpdateFrame:
+			// Ignored; nothing to demultiplex.
+		}
+	}
+}
+
+// emitH2Request forwards the first completed HEADERS/CONTINUATION sequence
+// on a stream as a synthetic request; subsequent calls (request trailers)
+// are a no-op. Unlike the HTTP/1.1 path, responses are matched by stream ID
+// (see runInH2), so the request is never pushed onto bds.requests.
+func (h *TCPStream) emitH2Request(bds *BidiStream, s *h2Stream, streamID uint32) {
+	if s.headersEmitted {
+		return
+	}
+	s.headersEmitted = true
+	s.isGRPC = isGRPCContentType(s.header.Get("content-type"))
+	if s.isGRPC {
+		rpc := bds.h2RPCState(streamID)
+		rpc.mu.Lock()
+		rpc.path = s.path
+		rpc.mu.Unlock()
+	}
+
+	req := synthesizeRequest(s)
+	if err := h.storage.SentRequest(h.bidikey, int64(streamID), time.Now(), req); err != nil {
+		log.Println("Error storing request", err)
+	}
+	if h.tap != nil {
+		h.tap.PublishRequest(h.bidikey, int64(streamID), &httpRequestSummary{
+			Host: s.authority, Method: s.method, Path: s.path})
+	}
+}
+
+// runInH2 is the response-side counterpart of runOutH2: it decodes HEADERS
+// and DATA frames on a server-to-client stream and forwards each completed
+// response into storage, keyed by the same HTTP/2 stream ID as the request.
+func (h *TCPStream) runInH2(bds *BidiStream, buf *bufio.Reader) {
+	conn := newH2Conn()
+	framer := http2.NewFramer(ioutil.Discard, buf)
+
+	for {
+		frame, err := framer.ReadFrame()
+		if err == io.EOF {
+			return
+		} else if err != nil {
+			if h.closed {
+				// error occurred after stream was closed, ignore.
+			} else {
+				log.Println("Error reading HTTP/2 frame", h.netFlow, h.tcpFlow, ":", err)
+			}
+			return
+		}
+
+		switch f := frame.(type) {
+		case *http2.HeadersFrame:
+			s := conn.stream(f.StreamID)
+			decodeH2Headers(conn.hdec, f.HeaderBlockFragment(), s)
+			if f.HeadersEnded() {
+				h.emitH2Response(bds, s, f.StreamID)
+			}
+		case *http2.ContinuationFrame:
+			s := conn.stream(f.StreamID)
+			decodeH2Headers(conn.hdec, f.HeaderBlockFragment(), s)
+			if f.HeadersEnded() {
+				h.emitH2Response(bds, s, f.StreamID)
+			}
+		case *http2.DataFrame:
+			s := conn.stream(f.StreamID)
+			if s.isGRPC {
+				s.respFrames.feed(f.Data())
+			} else {
+				s.body.Write(f.Data())
+			}
+		}
+	}
+}
+
+// emitH2Response forwards the first completed HEADERS/CONTINUATION sequence
+// on a stream as a synthetic response. A second HEADERS sequence on the same
+// stream carries gRPC trailers (grpc-status/grpc-message), which close out
+// the per-RPC accounting built up from the request and response DATA frames.
+func (h *TCPStream) emitH2Response(bds *BidiStream, s *h2Stream, streamID uint32) {
+	if !s.headersEmitted {
+		s.headersEmitted = true
+		s.isGRPC = isGRPCContentType(s.header.Get("content-type"))
+
+		resp := synthesizeResponse(s)
+		if err := h.storage.ReceivedResponse(h.bidikey, int64(streamID), time.Now(), resp); err != nil {
+			log.Println("Error storing response", err)
+		}
+		if h.tap != nil {
+			h.tap.PublishResponse(h.bidikey, int64(streamID), resp.StatusCode)
+		}
+		return
+	}
+
+	if !s.isGRPC {
+		return
+	}
+	rpc := bds.h2RPCState(streamID)
+	rpc.mu.Lock()
+	path := rpc.path
+	reqMessageCount := rpc.reqFrames.messageCount
+	reqByteSize := rpc.reqFrames.byteSize
+	rpc.mu.Unlock()
+	bds.h2mu.Lock()
+	delete(bds.h2States, streamID)
+	bds.h2mu.Unlock()
+
+	s.grpcStatus = s.header.Get("grpc-status")
+	s.grpcMessage = s.header.Get("grpc-message")
+	err := h.storage.GRPCCallComplete(h.bidikey, streamID, path,
+		reqMessageCount, reqByteSize,
+		s.respFrames.messageCount, s.respFrames.byteSize,
+		s.grpcStatus, s.grpcMessage)
+	if err != nil {
+		log.Println("Error storing gRPC call", err)
+	}
+}
+
+// decodeH2Headers feeds a HEADERS/CONTINUATION header block fragment through
+// the connection's persistent HPACK decoder and records the pseudo and
+// regular headers onto s.
+func decodeH2Headers(hdec *hpack.Decoder, fragment []byte, s *h2Stream) {
+	hdec.SetEmitFunc(func(f hpack.HeaderField) {
+		switch f.Name {
+		case ":method":
+			s.method = f.Value
+		case ":path":
+			s.path = f.Value
+		case ":authority":
+			s.authority = f.Value
+		case ":scheme":
+			s.scheme = f.Value
+		case ":status":
+			s.status = f.Value
+		default:
+			s.header.Add(f.Name, f.Value)
+		}
+	})
+	if _, err := hdec.Write(fragment); err != nil {
+		log.Println("Error decoding HPACK header block", err)
+	}
+}
+
+// synthesizeRequest builds an *http.Request out of the pseudo-headers and
+// body accumulated for an HTTP/2 stream, matching what http.ReadRequest
+// would hand back for the HTTP/1.1 equivalent.
+func synthesizeRequest(s *h2Stream) *http.Request {
+	u, _ := url.ParseRequestURI(s.path)
+	if u == nil {
+		u = &url.URL{Path: s.path}
+	}
+	u.Scheme = s.scheme
+	u.Host = s.authority
+
+	return &http.Request{
+		Method:     s.method,
+		URL:        u,
+		Proto:      "HTTP/2.0",
+		ProtoMajor: 2,
+		ProtoMinor: 0,
+		Header:     s.header,
+		Host:       s.authority,
+		Body:       ioutil.NopCloser(bytes.NewReader(s.body.Bytes())),
+	}
+}
+
+// synthesizeResponse builds an *http.Response out of the pseudo-headers and
+// body accumulated for an HTTP/2 stream.
+func synthesizeResponse(s *h2Stream) *http.Response {
+	code, _ := strconv.Atoi(s.status)
+	return &http.Response{
+		StatusCode: code,
+		Status:     s.status,
+		Proto:      "HTTP/2.0",
+		ProtoMajor: 2,
+		ProtoMinor: 0,
+		Header:     s.header,
+		Body:       ioutil.NopCloser(bytes.NewReader(s.body.Bytes())),
+	}
+}
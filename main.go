@@ -19,6 +19,7 @@ import (
 	"code.google.com/p/gopacket"
 	"code.google.com/p/gopacket/layers"
 	"code.google.com/p/gopacket/pcap"
+	"code.google.com/p/gopacket/reassembly"
 	"code.google.com/p/gopacket/tcpassembly"
 	"code.google.com/p/gopacket/tcpassembly/tcpreader"
 	"flag"
@@ -31,6 +32,7 @@ import (
 	"runtime"
 	"runtime/pprof"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -40,14 +42,39 @@ var inputfile = flag.String("infile", "", "read packets from file")
 var logAllPackets = flag.Bool("v", false, "Logs every packet in great detail")
 var launchCmd = flag.String("e", "", "Launches the command and logs its traffic")
 var cpuprofile = flag.String("cpuprofile", "", "write cpu profile to file")
+var bpfFilter = flag.String("bpf", "tcp and (port 80 or port 443)", "BPF filter applied to captured packets")
 
 type BidiStream struct {
 	key      uint64
 	in, out  *TCPStream
 	requests chan *http.Request
+
+	// isHTTP2 and protoKnown let runIn wait for runOut to sniff the
+	// connection preface before deciding which frame parser to run.
+	isHTTP2    bool
+	protoKnown chan struct{}
+
+	// tlsClientRandom carries the client random runOut's decrypter parses
+	// out of the ClientHello over to runIn's decrypter, which never sees a
+	// ClientHello of its own but needs the same random to look up the
+	// server-side traffic secrets. tlsCipherSuite carries the negotiated
+	// suite the other way: runIn's decrypter is the one that sees the
+	// ServerHello naming it, but runOut's decrypter needs it too in order
+	// to derive its own traffic keys.
+	tlsClientRandom chan []byte
+	tlsCipherSuite  chan uint16
+
+	// h2mu guards h2States, the gRPC accounting shared between runOutH2 and
+	// runInH2, which otherwise track a given HTTP/2 stream's request and
+	// response halves in entirely separate h2Conns.
+	h2mu     sync.Mutex
+	h2States map[uint32]*h2RPCState
 }
 
 // TCPStream will handle the actual decoding of http requests and responses.
+// It implements reassembly.Stream: reassembled segments are handed to the
+// embedded tcpreader.ReaderStream, which runOut/runIn consume as a plain
+// io.Reader.
 type TCPStream struct {
 	netFlow, tcpFlow gopacket.Flow
 	readStream       tcpreader.ReaderStream
@@ -55,13 +82,163 @@ type TCPStream struct {
 	bidikey          uint64
 	closed           bool
 	reqInProgress    *http.Request
+	keylog           *sslKeyLog
+	tap              *tapHub
+	isOutbound       bool
+
+	// TCP quality counters accumulated across the life of the connection,
+	// reported alongside payload byte counts so per-request latency can be
+	// correlated with retransmissions, reordering, gaps and overlaps.
+	retransmittedBytes uint64
+	outOfOrderBytes    uint64
+	missedBytes        uint64
+	overlapBytes       uint64
+}
+
+// Accept implements reassembly.Stream. It lets every segment through, while
+// using the TCP sequence number relative to nextSeq (the sequence the
+// assembler expects next) to notice retransmitted segments before the
+// reassembler reorders or drops them.
+func (h *TCPStream) Accept(tcp *layers.TCP, ci gopacket.CaptureInfo, dir reassembly.TCPFlowDirection, nextSeq reassembly.Sequence, start *bool, ac reassembly.AssemblerContext) bool {
+	if *start {
+		*start = false
+	} else if overlap := reassembly.Sequence(tcp.Seq).Difference(nextSeq); overlap > 0 {
+		// This segment starts before nextSeq: some or all of its bytes were
+		// already delivered, so the sender must have retransmitted them.
+		// Only the overlapping prefix counts here; bytes past nextSeq are
+		// new data, and overlap within the reassembly buffer itself is
+		// already tallied as stats.OverlapBytes in ReassembledSG.
+		if overlap > len(tcp.Payload) {
+			overlap = len(tcp.Payload)
+		}
+		h.retransmittedBytes += uint64(overlap)
+	}
+	return true
+}
+
+// ReassembledSG implements reassembly.Stream. It feeds the reassembled
+// bytes into readStream for the HTTP/HTTP2 parsers, and accumulates the
+// gap/overlap statistics the assembler tracked while producing them.
+func (h *TCPStream) ReassembledSG(sg reassembly.ScatterGather, ac reassembly.AssemblerContext) {
+	length, _ := sg.Lengths()
+	_, _, _, skip := sg.Info()
+	stats := sg.Stats()
+
+	if skip > 0 {
+		h.missedBytes += uint64(skip)
+	}
+	if stats.OverlapBytes > 0 {
+		h.overlapBytes += uint64(stats.OverlapBytes)
+	}
+	if stats.QueuedBytes > 0 {
+		h.outOfOrderBytes += uint64(stats.QueuedBytes)
+	}
+
+	// sg.Fetch's slice is backed by the reassembly page pool and only valid
+	// for the duration of this callback; readStream.Reassembled hands it to
+	// the HTTP/HTTP2 parsers on another goroutine, so it must be copied
+	// before it escapes here.
+	data := make([]byte, length)
+	copy(data, sg.Fetch(length))
+	h.readStream.Reassembled([]tcpassembly.Reassembly{{Bytes: data, Skip: skip}})
+
+	// saved bytes are held back by the assembler and redelivered as length
+	// in a later call, so only length bytes were actually delivered here.
+	var err error
+	if h.isOutbound {
+		err = h.storage.OutgoingTCPPacket(h.bidikey, uint32(length),
+			h.retransmittedBytes, h.outOfOrderBytes, h.missedBytes, h.overlapBytes)
+	} else {
+		err = h.storage.IncomingTCPPacket(h.bidikey, uint32(length),
+			h.retransmittedBytes, h.outOfOrderBytes, h.missedBytes, h.overlapBytes)
+	}
+	if err != nil {
+		log.Println("Error storing TCP packet stats", err)
+	}
+
+	if h.tap != nil {
+		h.tap.UpdateConnStats(h.bidikey, connStats{
+			retransmittedBytes: h.retransmittedBytes,
+			outOfOrderBytes:    h.outOfOrderBytes,
+			missedBytes:        h.missedBytes,
+			overlapBytes:       h.overlapBytes,
+		})
+	}
+}
+
+// ReassemblyComplete implements reassembly.Stream. Unlike the EOF-based
+// timing runOut/runIn used to rely on, this fires exactly once the
+// assembler considers the connection done, including half-closed and
+// RST'd connections, so CloseTCPConnection gets an accurate timestamp. It
+// fires once per half-connection Stream (in and out), so only the outbound
+// half records the close; otherwise every bidi connection would close
+// twice.
+func (h *TCPStream) ReassemblyComplete(ac reassembly.AssemblerContext) bool {
+	h.readStream.ReassemblyComplete()
+	if h.isOutbound {
+		if err := h.storage.CloseTCPConnection(h.bidikey, time.Now()); err != nil {
+			log.Println("Error storing connection close timestamp", err)
+		}
+		if h.tap != nil {
+			h.tap.CloseConnection(h.bidikey)
+		}
+	}
+	return true
 }
 
-// runOut is a blocking function that reads HTTP requests from a stream.
+// decryptIfTLS peeks at buf for a TLS handshake record starting the
+// connection's half of the handshake (a ClientHello outbound, a ServerHello
+// inbound). If one is found and a key log file was configured via -keylog,
+// it wraps buf in a tlsDecrypter and returns a fresh *bufio.Reader over the
+// decrypted application data stream; otherwise it returns buf unchanged.
+func (h *TCPStream) decryptIfTLS(buf *bufio.Reader, bds *BidiStream, isClient bool) *bufio.Reader {
+	if h.keylog == nil {
+		return buf
+	}
+	if isClient {
+		if !looksLikeTLSClientHello(buf) {
+			return buf
+		}
+		dec := newTLSDecrypter(buf, h.keylog, true)
+		dec.announceRandom = func(random []byte) {
+			select {
+			case bds.tlsClientRandom <- random:
+			default:
+			}
+		}
+		dec.cipherSuiteSource = bds.tlsCipherSuite
+		return bufio.NewReader(dec)
+	}
+
+	if !looksLikeTLSServerHello(buf) {
+		return buf
+	}
+	dec := newTLSDecrypter(buf, h.keylog, false)
+	dec.randomSource = bds.tlsClientRandom
+	dec.announceCipherSuite = func(suite uint16) {
+		select {
+		case bds.tlsCipherSuite <- suite:
+		default:
+		}
+	}
+	return bufio.NewReader(dec)
+}
+
+// runOut is a blocking function that reads HTTP requests from a stream. It
+// first sniffs the connection preface to decide whether this is plain
+// HTTP/1.1 or HTTP/2, and dispatches to the matching frame parser.
 func (h *TCPStream) runOut(bds *BidiStream) {
-	buf := bufio.NewReader(&h.readStream)
+	buf := h.decryptIfTLS(bufio.NewReader(&h.readStream), bds, true)
 	var reqID int64
 
+	bds.isHTTP2 = looksLikeHTTP2Preface(buf)
+	close(bds.protoKnown)
+
+	if bds.isHTTP2 {
+		h.runOutH2(bds, buf)
+		return
+	}
+
 	for {
 		/*		_, err := buf.Peek(1)
 				if err == io.EOF {
@@ -69,12 +246,8 @@ func (h *TCPStream) runOut(bds *BidiStream) {
 				}*/
 		req, err := http.ReadRequest(buf)
 		if err == io.EOF {
-			//			log.Println("EOF while reading stream", h.netFlow, h.tcpFlow, ":", err)
 			// We must read until we see an EOF... very important!
-			err = h.storage.CloseTCPConnection(h.bidikey, time.Now())
-			if err != nil {
-				log.Println("Error storing connection close timestamp", err)
-			}
+			// ReassemblyComplete records the connection close timestamp.
 			return
 		} else if err != nil {
 			tcpreader.DiscardBytesToFirstError(buf)
@@ -93,6 +266,10 @@ func (h *TCPStream) runOut(bds *BidiStream) {
 			if err != nil {
 				log.Println("Error storing request", err)
 			}
+			if h.tap != nil {
+				h.tap.PublishRequest(h.bidikey, reqID, &httpRequestSummary{
+					Host: req.Host, Method: req.Method, Path: req.URL.Path})
+			}
 
 			reqID++
 			//			fmt.Print(".")
@@ -102,11 +279,25 @@ func (h *TCPStream) runOut(bds *BidiStream) {
 	}
 }
 
-// runIn is a blocking function that reads HTTP responses from a stream.
+// runIn is a blocking function that reads HTTP responses from a stream. It
+// waits for runOut to sniff the protocol on the request half of the
+// connection, then dispatches to the matching frame parser.
 func (h *TCPStream) runIn(bds *BidiStream) {
-	buf := bufio.NewReader(&h.readStream)
+	buf := h.decryptIfTLS(bufio.NewReader(&h.readStream), bds, false)
 	var reqID int64
 
+	// Wait for the first response bytes before blocking on protoKnown: with
+	// -keylog, this drives runIn's decrypter past the ServerHello, which
+	// hands runOut's decrypter the cipher suite it needs to sniff the
+	// preface.
+	buf.Peek(1)
+
+	<-bds.protoKnown
+	if bds.isHTTP2 {
+		h.runInH2(bds, buf)
+		return
+	}
+
 	for {
 		// Don't start reading a response if no data is available
 		_, err := buf.Peek(1)
@@ -145,6 +336,9 @@ func (h *TCPStream) runIn(bds *BidiStream) {
 			if err != nil {
 				log.Println("Error storing response", err)
 			}
+			if h.tap != nil {
+				h.tap.PublishResponse(h.bidikey, reqID, resp.StatusCode)
+			}
 
 			reqID++
 			h.reqInProgress = nil
@@ -157,19 +351,30 @@ func (h *TCPStream) runIn(bds *BidiStream) {
 
 }
 
-// httpStreamFactory implements tcpassembly.StreamFactory
+// httpStreamFactory implements reassembly.StreamFactory
 type httpStreamFactory struct {
 	bidiStreams map[uint64]*BidiStream
 	storage     *Storage
 	closed      bool
+	keylog      *sslKeyLog
+	tap         *tapHub
 }
 
 func NewStreamFactory(s *Storage) *httpStreamFactory {
+	var keylog *sslKeyLog
+	if *keylogFile != "" {
+		keylog = newSSLKeyLog(*keylogFile)
+	}
+	var tap *tapHub
+	if *listenAddr != "" {
+		tap = newTapHub()
+	}
 	return &httpStreamFactory{bidiStreams: make(map[uint64]*BidiStream),
-		storage: s}
+		storage: s, keylog: keylog, tap: tap}
 }
 
-func (h *httpStreamFactory) New(netFlow, tcpFlow gopacket.Flow) tcpassembly.Stream {
+// New implements reassembly.StreamFactory.
+func (h *httpStreamFactory) New(netFlow, tcpFlow gopacket.Flow, tcp *layers.TCP, ac reassembly.AssemblerContext) reassembly.Stream {
 
 	// Watch out: this function can still get called even after all
 	// streams were flushed (via FlushAll) and closed.
@@ -186,13 +391,19 @@ func (h *httpStreamFactory) New(netFlow, tcpFlow gopacket.Flow) tcpassembly.Stre
 		readStream: tcpreader.NewReaderStream(),
 		storage:    h.storage,
 		bidikey:    key,
+		keylog:     h.keylog,
+		tap:        h.tap,
 	}
 
 	bds := h.bidiStreams[key]
 	if bds == nil {
 		//		log.Println("reading stream", netFlow, tcpFlow)
+		hstream.isOutbound = true
 		bds = &BidiStream{out: hstream, key: key,
-			requests: make(chan *http.Request, 100)}
+			requests:        make(chan *http.Request, 100),
+			protoKnown:      make(chan struct{}),
+			tlsClientRandom: make(chan []byte, 1),
+			tlsCipherSuite:  make(chan uint16, 1)}
 		h.bidiStreams[key] = bds
 		// Start a coroutine per stream, to ensure that all data is read from
 		// the reader stream
@@ -209,43 +420,8 @@ func (h *httpStreamFactory) New(netFlow, tcpFlow gopacket.Flow) tcpassembly.Stre
 		go hstream.runIn(bds)
 	}
 
-	// ReaderStream implements tcpassembly.Stream, so we can return a pointer to it.
-	return &hstream.readStream
-}
-
-// LogPacketSize calculates the payload length of a TCP packet and stores it
-// in the storage layer.
-func (h *httpStreamFactory) LogPacketSize(packet gopacket.Packet) {
-	netFlow := packet.NetworkLayer().NetworkFlow()
-	tcpFlow := packet.TransportLayer().TransportFlow()
-	key := netFlow.FastHash() ^ tcpFlow.FastHash()
-
-	ipv4Layer := packet.Layer(layers.LayerTypeIPv4)
-	ipv4, _ := ipv4Layer.(*layers.IPv4)
-
-	tcpLayer := packet.Layer(layers.LayerTypeTCP)
-	tcp, _ := tcpLayer.(*layers.TCP)
-
-	bds := h.bidiStreams[key]
-	if bds == nil || bds.in == nil || bds.out == nil {
-		return
-	}
-
-	payloadLength := uint32(ipv4.Length - uint16(ipv4.IHL)*4 - uint16(tcp.DataOffset)*4)
-
-	if bds.in.netFlow == netFlow {
-		// This is an incoming packet
-		err := h.storage.IncomingTCPPacket(key, payloadLength)
-		if err != nil {
-			panic(err)
-		}
-	} else {
-		// This is an outgoing packet
-		err := h.storage.OutgoingTCPPacket(key, payloadLength)
-		if err != nil {
-			panic(err)
-		}
-	}
+	// TCPStream implements reassembly.Stream.
+	return hstream
 }
 
 // createProcessEndedChannel creates and returns a channel that will be used
@@ -277,6 +453,17 @@ func createTimeoutChannel(t time.Duration) (timeout chan bool) {
 	return
 }
 
+// captureContext adapts a packet's capture metadata to reassembly's
+// AssemblerContext interface, which ReassembledSG/ReassemblyComplete hooks
+// receive so they can tell which packet triggered them.
+type captureContext struct {
+	gopacket.CaptureInfo
+}
+
+func (c *captureContext) GetCaptureInfo() gopacket.CaptureInfo {
+	return c.CaptureInfo
+}
+
 func createNetDescChannel() (netDescs chan NetDescriptor) {
 	netDescSource := NewOSXNetDescSource()
 	netDescs = netDescSource.Descriptors()
@@ -310,8 +497,18 @@ func main() {
 
 	// Set up assembly
 	streamFactory := NewStreamFactory(storage)
-	streamPool := tcpassembly.NewStreamPool(streamFactory)
-	assembler := tcpassembly.NewAssembler(streamPool)
+	streamPool := reassembly.NewStreamPool(streamFactory)
+	assembler := reassembly.NewAssembler(streamPool)
+
+	if streamFactory.tap != nil {
+		mux := newTapServeMux(streamFactory.tap)
+		go func() {
+			log.Printf("tap server listening on %s", *listenAddr)
+			if err := http.ListenAndServe(*listenAddr, mux); err != nil {
+				log.Println("tap server error", err)
+			}
+		}()
+	}
 
 	// Setup CTRL-C handler channel
 	ctrlc := createCtrlCchannel()
@@ -330,13 +527,21 @@ func main() {
 
 	if err != nil {
 		panic(err)
-	} else if err := handle.SetBPFFilter("tcp and port 80"); err != nil {
+	} else if err := handle.SetBPFFilter(*bpfFilter); err != nil {
 		panic(err)
 	}
 	log.Println("reading in packets. Press CTRL-C to end and report.")
 	packetSource := gopacket.NewPacketSource(handle, handle.LinkType())
 	packets := packetSource.Packets()
 
+	var pcapWriter *scopedPcapWriter
+	if *outfile != "" {
+		pcapWriter, err = newScopedPcapWriter(*outfile, handle.LinkType())
+		if err != nil {
+			log.Fatal("Error opening -w output file: ", err)
+		}
+	}
+
 	// Run the external command
 	//	pid := uint32(0)
 	var cmd_done chan error
@@ -385,12 +590,17 @@ loop:
 			}
 
 			if storage.PacketInScope(packet) {
-				streamFactory.LogPacketSize(packet)
+				if pcapWriter != nil {
+					if err := pcapWriter.WritePacket(packet.Metadata().CaptureInfo, packet.Data()); err != nil {
+						log.Println("Error writing packet to -w output file", err)
+					}
+				}
+
 				netFlow := packet.NetworkLayer().NetworkFlow()
 				tcp := packet.TransportLayer().(*layers.TCP)
 
-				assembler.AssembleWithTimestamp(netFlow, tcp,
-					packet.Metadata().Timestamp)
+				assembler.AssembleWithContext(netFlow, tcp,
+					&captureContext{packet.Metadata().CaptureInfo})
 			}
 		case err := <-cmd_done:
 			if err != nil {
@@ -427,6 +637,12 @@ loop:
 
 	assembler.FlushAll()
 
+	if pcapWriter != nil {
+		if err := pcapWriter.Close(); err != nil {
+			log.Println("Error closing -w output file", err)
+		}
+	}
+
 	// Close the storage layer. This will block until all pending inserts in
 	// the db are handled.
 	storage.Close()
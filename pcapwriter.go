@@ -0,0 +1,64 @@
+// Copyright 2014 Lieven Govaerts. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"code.google.com/p/gopacket"
+	"code.google.com/p/gopacket/pcapgo"
+	"flag"
+	"os"
+)
+
+var outfile = flag.String("w", "", "write in-scope packets to this pcap-ng file")
+
+// scopedPcapWriter writes the original, raw bytes of every packet that
+// Storage.PacketInScope accepts to a pcap-ng file, for deeper analysis in
+// Wireshark. PacketInScope accepts every packet the -bpf filter lets
+// through; the output is not narrowed to the traffic of the -e process.
+type scopedPcapWriter struct {
+	f *os.File
+	w *pcapgo.NgWriter
+}
+
+// newScopedPcapWriter creates path and writes a pcap-ng header recording
+// linkType, the link layer of the handle packets are read from.
+func newScopedPcapWriter(path string, linkType gopacket.LinkType) (*scopedPcapWriter, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+
+	w, err := pcapgo.NewNgWriter(f, linkType)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return &scopedPcapWriter{f: f, w: w}, nil
+}
+
+// WritePacket appends packet's raw bytes and capture timestamp to the file.
+func (s *scopedPcapWriter) WritePacket(ci gopacket.CaptureInfo, data []byte) error {
+	return s.w.WritePacket(ci, data)
+}
+
+// Close flushes the pcap-ng writer and closes the underlying file.
+func (s *scopedPcapWriter) Close() error {
+	if err := s.w.Flush(); err != nil {
+		s.f.Close()
+		return err
+	}
+	return s.f.Close()
+}
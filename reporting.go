@@ -0,0 +1,144 @@
+// Copyright 2014 Lieven Govaerts. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// httpCallSummary pairs up a recorded request with its response, once
+// both halves of the exchange have been seen.
+type httpCallSummary struct {
+	bidikey            uint64
+	reqID              int64
+	host, method, path string
+	status             int
+	sentAt, receivedAt time.Time
+}
+
+// grpcCallSummary is the reporting-side view of one storageRecord of
+// kind "grpc_call".
+type grpcCallSummary struct {
+	bidikey                           uint64
+	streamID                          uint32
+	method                            string
+	reqMessageCount, respMessageCount int
+	reqByteSize, respByteSize         int64
+	status, message                   string
+}
+
+// Reporting reads back everything Storage recorded for the capture just
+// finished and prints a summary a user can act on: every HTTP(S) call
+// with its latency and status, every gRPC call with its message counts
+// and status, and the TCP quality counters for every connection.
+type Reporting struct {
+	calls      []httpCallSummary
+	grpcCalls  []grpcCallSummary
+	tcpQuality map[uint64]storageRecord
+}
+
+// NewReporting reads back dbFile and groups its records into the
+// request/response pairs, gRPC calls and TCP quality snapshots Report
+// prints.
+func NewReporting() (*Reporting, error) {
+	records, err := readStorageRecords()
+	if err != nil {
+		return nil, err
+	}
+
+	requests := make(map[httpExchangeKey]storageRecord)
+	latestTCP := make(map[struct {
+		bidikey uint64
+		kind    string
+	}]storageRecord)
+	r := &Reporting{tcpQuality: make(map[uint64]storageRecord)}
+
+	for _, rec := range records {
+		switch rec.Kind {
+		case "request":
+			requests[httpExchangeKey{rec.BidiKey, rec.ReqID}] = rec
+		case "response":
+			req, ok := requests[httpExchangeKey{rec.BidiKey, rec.ReqID}]
+			if !ok {
+				continue
+			}
+			r.calls = append(r.calls, httpCallSummary{
+				bidikey: rec.BidiKey, reqID: rec.ReqID,
+				host: req.Host, method: req.Method, path: req.Path,
+				status: rec.Status, sentAt: req.At, receivedAt: rec.At,
+			})
+		case "grpc_call":
+			r.grpcCalls = append(r.grpcCalls, grpcCallSummary{
+				bidikey: rec.BidiKey, streamID: rec.StreamID, method: rec.Path,
+				reqMessageCount: rec.ReqMessageCount, respMessageCount: rec.RespMessageCount,
+				reqByteSize: rec.ReqByteSize, respByteSize: rec.RespByteSize,
+				status: rec.GRPCStatus, message: rec.GRPCMessage,
+			})
+		case "tcp_out", "tcp_in":
+			// Each record carries the cumulative counters for one direction
+			// of the connection, so the latest one per direction is kept
+			// and the two directions are summed below.
+			latestTCP[struct {
+				bidikey uint64
+				kind    string
+			}{rec.BidiKey, rec.Kind}] = rec
+		}
+	}
+
+	for k, rec := range latestTCP {
+		sum := r.tcpQuality[k.bidikey]
+		sum.RetransmittedBytes += rec.RetransmittedBytes
+		sum.OutOfOrderBytes += rec.OutOfOrderBytes
+		sum.MissedBytes += rec.MissedBytes
+		sum.OverlapBytes += rec.OverlapBytes
+		r.tcpQuality[k.bidikey] = sum
+	}
+
+	return r, nil
+}
+
+// Report prints the per-request latency/status table, the per-RPC gRPC
+// table, and the per-connection TCP quality table to stdout.
+func (r *Reporting) Report() error {
+	fmt.Println("HTTP(S) calls:")
+	fmt.Printf("%-22s %-6s %-40s %-6s %s\n", "HOST", "METHOD", "PATH", "STATUS", "LATENCY")
+	for _, c := range r.calls {
+		fmt.Printf("%-22s %-6s %-40s %-6d %s\n",
+			c.host, c.method, c.path, c.status, c.receivedAt.Sub(c.sentAt))
+	}
+
+	if len(r.grpcCalls) > 0 {
+		fmt.Println()
+		fmt.Println("gRPC calls:")
+		fmt.Printf("%-40s %-12s %-12s %-8s %s\n", "METHOD", "REQ MSGS", "RESP MSGS", "STATUS", "MESSAGE")
+		for _, c := range r.grpcCalls {
+			fmt.Printf("%-40s %-12d %-12d %-8s %s\n",
+				c.method, c.reqMessageCount, c.respMessageCount, c.status, c.message)
+		}
+	}
+
+	if len(r.tcpQuality) > 0 {
+		fmt.Println()
+		fmt.Println("TCP quality per connection:")
+		fmt.Printf("%-20s %-12s %-12s %-10s %s\n", "CONN", "RETRANSMIT", "OUT-OF-ORDER", "MISSED", "OVERLAP")
+		for bidikey, rec := range r.tcpQuality {
+			fmt.Printf("%-20d %-12d %-12d %-10d %d\n",
+				bidikey, rec.RetransmittedBytes, rec.OutOfOrderBytes, rec.MissedBytes, rec.OverlapBytes)
+		}
+	}
+
+	return nil
+}
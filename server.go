@@ -0,0 +1,274 @@
+// Copyright 2014 Lieven Govaerts. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"golang.org/x/net/websocket"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var listenAddr = flag.String("listen", "", "address to expose a live HTTP tap server on, e.g. :8080 (disabled if empty)")
+
+// tapEvent is the JSON shape trmon streams to tap clients for every
+// completed request or response, mirroring what's recorded into Storage.
+type tapEvent struct {
+	Type      string    `json:"type"` // "request" or "response"
+	BidiKey   uint64    `json:"bidiKey"`
+	ReqID     int64     `json:"reqId"`
+	Timestamp time.Time `json:"timestamp"`
+	Host      string    `json:"host,omitempty"`
+	Method    string    `json:"method,omitempty"`
+	Path      string    `json:"path,omitempty"`
+	Status    int       `json:"status,omitempty"`
+}
+
+// maxTrackedHosts bounds the /metrics per-host request counter so a
+// long-running capture that sees many distinct Hosts can't grow
+// requestsByHost without limit. Hosts already being tracked keep
+// incrementing past the limit; only new hosts are dropped.
+const maxTrackedHosts = 1000
+
+// connStats is the latest TCP quality snapshot for one connection, used to
+// render the per-connection retransmit counters in /metrics.
+type connStats struct {
+	retransmittedBytes uint64
+	outOfOrderBytes    uint64
+	missedBytes        uint64
+	overlapBytes       uint64
+}
+
+// tapHub fans out completed request/response events to subscribed SSE and
+// WebSocket clients, and accumulates the counters /metrics reports.
+type tapHub struct {
+	mu          sync.Mutex
+	subscribers map[chan tapEvent]*regexp.Regexp
+
+	inFlight        int64
+	requestsByHost  map[string]int64
+	statusHistogram map[string]int64
+	connStats       map[uint64]connStats
+}
+
+func newTapHub() *tapHub {
+	return &tapHub{
+		subscribers:     make(map[chan tapEvent]*regexp.Regexp),
+		requestsByHost:  make(map[string]int64),
+		statusHistogram: make(map[string]int64),
+		connStats:       make(map[uint64]connStats),
+	}
+}
+
+// subscribe registers a new client, optionally filtering the events it
+// receives by a host/path regular expression, and returns the channel to
+// read from along with a function to unregister it.
+func (hub *tapHub) subscribe(filter *regexp.Regexp) (chan tapEvent, func()) {
+	ch := make(chan tapEvent, 64)
+	hub.mu.Lock()
+	hub.subscribers[ch] = filter
+	hub.mu.Unlock()
+
+	return ch, func() {
+		hub.mu.Lock()
+		delete(hub.subscribers, ch)
+		hub.mu.Unlock()
+		close(ch)
+	}
+}
+
+func (hub *tapHub) publish(ev tapEvent) {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+
+	for ch, filter := range hub.subscribers {
+		if filter != nil && !filter.MatchString(ev.Host+ev.Path) {
+			continue
+		}
+		select {
+		case ch <- ev:
+		default:
+			// Slow client; drop the event rather than block the capture.
+		}
+	}
+}
+
+// PublishRequest records a completed request for the /metrics counters and
+// fans it out to tap subscribers.
+func (hub *tapHub) PublishRequest(bidikey uint64, reqID int64, req *httpRequestSummary) {
+	atomic.AddInt64(&hub.inFlight, 1)
+
+	hub.mu.Lock()
+	if _, tracked := hub.requestsByHost[req.Host]; tracked || len(hub.requestsByHost) < maxTrackedHosts {
+		hub.requestsByHost[req.Host]++
+	}
+	hub.mu.Unlock()
+
+	hub.publish(tapEvent{
+		Type: "request", BidiKey: bidikey, ReqID: reqID, Timestamp: time.Now(),
+		Host: req.Host, Method: req.Method, Path: req.Path,
+	})
+}
+
+// PublishResponse records a completed response for the /metrics counters
+// and fans it out to tap subscribers.
+func (hub *tapHub) PublishResponse(bidikey uint64, reqID int64, status int) {
+	if n := atomic.AddInt64(&hub.inFlight, -1); n < 0 {
+		atomic.StoreInt64(&hub.inFlight, 0)
+	}
+
+	bucket := fmt.Sprintf("%dxx", status/100)
+	hub.mu.Lock()
+	hub.statusHistogram[bucket]++
+	hub.mu.Unlock()
+
+	hub.publish(tapEvent{
+		Type: "response", BidiKey: bidikey, ReqID: reqID, Timestamp: time.Now(),
+		Status: status,
+	})
+}
+
+// UpdateConnStats records the latest TCP quality counters for a connection,
+// surfaced as per-connection retransmit gauges in /metrics.
+func (hub *tapHub) UpdateConnStats(bidikey uint64, s connStats) {
+	hub.mu.Lock()
+	hub.connStats[bidikey] = s
+	hub.mu.Unlock()
+}
+
+// CloseConnection evicts the per-connection counters for a finished
+// connection, so long-running captures don't grow connStats without bound.
+func (hub *tapHub) CloseConnection(bidikey uint64) {
+	hub.mu.Lock()
+	delete(hub.connStats, bidikey)
+	hub.mu.Unlock()
+}
+
+// httpRequestSummary carries just the fields a tap event needs, so callers
+// don't have to build a full *http.Request to publish one.
+type httpRequestSummary struct {
+	Host   string
+	Method string
+	Path   string
+}
+
+// ServeSSE streams tap events to the client as Server-Sent Events, until the
+// client disconnects.
+func (hub *tapHub) ServeSSE(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	ch, cancel := hub.subscribe(parseTapFilter(r.URL))
+	defer cancel()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+
+	for {
+		select {
+		case ev, ok := <-ch:
+			if !ok {
+				return
+			}
+			data, err := json.Marshal(ev)
+			if err != nil {
+				continue
+			}
+			fmt.Fprintf(w, "data: %s\n\n", data)
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// ServeWS streams tap events to the client as WebSocket text frames.
+func (hub *tapHub) ServeWS(ws *websocket.Conn) {
+	ch, cancel := hub.subscribe(parseTapFilter(ws.Request().URL))
+	defer cancel()
+
+	for ev := range ch {
+		if err := websocket.JSON.Send(ws, ev); err != nil {
+			return
+		}
+	}
+}
+
+// ServeMetrics renders the tap hub's counters in Prometheus text format.
+func (hub *tapHub) ServeMetrics(w http.ResponseWriter, r *http.Request) {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+
+	fmt.Fprintln(w, "# HELP trmon_in_flight_requests Requests sent but not yet answered.")
+	fmt.Fprintln(w, "# TYPE trmon_in_flight_requests gauge")
+	fmt.Fprintf(w, "trmon_in_flight_requests %d\n", atomic.LoadInt64(&hub.inFlight))
+
+	fmt.Fprintln(w, "# HELP trmon_requests_total Requests observed per host.")
+	fmt.Fprintln(w, "# TYPE trmon_requests_total counter")
+	for host, count := range hub.requestsByHost {
+		fmt.Fprintf(w, "trmon_requests_total{host=%q} %d\n", host, count)
+	}
+
+	fmt.Fprintln(w, "# HELP trmon_responses_total Responses observed per status class.")
+	fmt.Fprintln(w, "# TYPE trmon_responses_total counter")
+	for bucket, count := range hub.statusHistogram {
+		fmt.Fprintf(w, "trmon_responses_total{status=%q} %d\n", bucket, count)
+	}
+
+	fmt.Fprintln(w, "# HELP trmon_tcp_retransmitted_bytes Retransmitted bytes observed per connection.")
+	fmt.Fprintln(w, "# TYPE trmon_tcp_retransmitted_bytes gauge")
+	for bidikey, s := range hub.connStats {
+		fmt.Fprintf(w, "trmon_tcp_retransmitted_bytes{conn=\"%d\"} %d\n", bidikey, s.retransmittedBytes)
+	}
+
+	fmt.Fprintln(w, "# HELP trmon_tcp_out_of_order_bytes Out-of-order bytes observed per connection.")
+	fmt.Fprintln(w, "# TYPE trmon_tcp_out_of_order_bytes gauge")
+	for bidikey, s := range hub.connStats {
+		fmt.Fprintf(w, "trmon_tcp_out_of_order_bytes{conn=\"%d\"} %d\n", bidikey, s.outOfOrderBytes)
+	}
+}
+
+// parseTapFilter builds the optional host/path filter regexp from the
+// "filter" query parameter, used to cut down chatter on busy captures.
+func parseTapFilter(u *url.URL) *regexp.Regexp {
+	expr := u.Query().Get("filter")
+	if expr == "" {
+		return nil
+	}
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return nil
+	}
+	return re
+}
+
+// newTapServeMux wires up the tap hub's SSE, WebSocket and metrics handlers.
+func newTapServeMux(hub *tapHub) *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/events", hub.ServeSSE)
+	mux.Handle("/ws", websocket.Handler(hub.ServeWS))
+	mux.HandleFunc("/metrics", hub.ServeMetrics)
+	return mux
+}
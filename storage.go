@@ -0,0 +1,198 @@
+// Copyright 2014 Lieven Govaerts. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"code.google.com/p/gopacket"
+	"encoding/json"
+	"flag"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+var dbFile = flag.String("db", "trmon.db", "file trmon appends captured request/response/TCP/gRPC records to; read back by the reporting pass once the capture ends")
+
+// storageRecord is the on-disk shape of one event appended to dbFile. Kind
+// says which of the other fields are meaningful; unused fields are left at
+// their zero value and dropped by omitempty, except At, which encoding/json
+// writes even when zero since it is a struct.
+type storageRecord struct {
+	Kind string `json:"kind"`
+
+	BidiKey  uint64    `json:"bidiKey,omitempty"`
+	ReqID    int64     `json:"reqId,omitempty"`
+	StreamID uint32    `json:"streamId,omitempty"`
+	At       time.Time `json:"at,omitempty"`
+
+	Host   string `json:"host,omitempty"`
+	Method string `json:"method,omitempty"`
+	Path   string `json:"path,omitempty"`
+	Status int    `json:"status,omitempty"`
+
+	Bytes              uint32 `json:"bytes,omitempty"`
+	RetransmittedBytes uint64 `json:"retransmittedBytes,omitempty"`
+	OutOfOrderBytes    uint64 `json:"outOfOrderBytes,omitempty"`
+	MissedBytes        uint64 `json:"missedBytes,omitempty"`
+	OverlapBytes       uint64 `json:"overlapBytes,omitempty"`
+
+	ReqMessageCount  int    `json:"reqMessageCount,omitempty"`
+	ReqByteSize      int64  `json:"reqByteSize,omitempty"`
+	RespMessageCount int    `json:"respMessageCount,omitempty"`
+	RespByteSize     int64  `json:"respByteSize,omitempty"`
+	GRPCStatus       string `json:"grpcStatus,omitempty"`
+	GRPCMessage      string `json:"grpcMessage,omitempty"`
+}
+
+// httpExchangeKey identifies one request/response pair: reqID is the
+// HTTP/1.1 request index on the connection, or the HTTP/2 stream ID.
+type httpExchangeKey struct {
+	bidikey uint64
+	reqID   int64
+}
+
+// Storage is trmon's append-only "database": every observation the
+// assembler produces is serialized as one JSON line in dbFile, so the
+// reporting pass run at the end of the capture (see reporting.go) can
+// reread it independently of the in-memory assembler state.
+type Storage struct {
+	mu  sync.Mutex
+	f   *os.File
+	enc *json.Encoder
+}
+
+// NewStorage truncates and opens dbFile for the events this run will
+// record.
+func NewStorage() (*Storage, error) {
+	f, err := os.Create(*dbFile)
+	if err != nil {
+		return nil, err
+	}
+	return &Storage{f: f, enc: json.NewEncoder(f)}, nil
+}
+
+// PacketInScope reports whether packet is traffic trmon should record.
+// The -bpf filter already restricts capture to HTTP(S) ports at the
+// kernel level; trmon has no further per-process scoping (e.g. limiting
+// to -e's child process) implemented yet, so every captured packet is in
+// scope.
+func (s *Storage) PacketInScope(packet gopacket.Packet) bool {
+	return true
+}
+
+// write appends rec to dbFile.
+func (s *Storage) write(rec storageRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.enc.Encode(rec)
+}
+
+// OpenTCPConnection records the moment a TCP connection trmon is tracking
+// was established.
+func (s *Storage) OpenTCPConnection(bidikey uint64, at time.Time) error {
+	return s.write(storageRecord{Kind: "conn_open", BidiKey: bidikey, At: at})
+}
+
+// CloseTCPConnection records the moment a tracked TCP connection closed.
+func (s *Storage) CloseTCPConnection(bidikey uint64, at time.Time) error {
+	return s.write(storageRecord{Kind: "conn_close", BidiKey: bidikey, At: at})
+}
+
+// OutgoingTCPPacket records the cumulative TCP quality counters after
+// delivering n client->server bytes on bidikey.
+func (s *Storage) OutgoingTCPPacket(bidikey uint64, n uint32, retransmitted, outOfOrder, missed, overlap uint64) error {
+	return s.writeTCPPacket("tcp_out", bidikey, n, retransmitted, outOfOrder, missed, overlap)
+}
+
+// IncomingTCPPacket records the cumulative TCP quality counters after
+// delivering n server->client bytes on bidikey.
+func (s *Storage) IncomingTCPPacket(bidikey uint64, n uint32, retransmitted, outOfOrder, missed, overlap uint64) error {
+	return s.writeTCPPacket("tcp_in", bidikey, n, retransmitted, outOfOrder, missed, overlap)
+}
+
+func (s *Storage) writeTCPPacket(kind string, bidikey uint64, n uint32, retransmitted, outOfOrder, missed, overlap uint64) error {
+	return s.write(storageRecord{
+		Kind: kind, BidiKey: bidikey, Bytes: n,
+		RetransmittedBytes: retransmitted, OutOfOrderBytes: outOfOrder,
+		MissedBytes: missed, OverlapBytes: overlap,
+	})
+}
+
+// SentRequest records req as sent on bidikey at at, identified for its
+// eventual response by reqID (the HTTP/1.1 request index on the
+// connection, or the HTTP/2 stream ID).
+func (s *Storage) SentRequest(bidikey uint64, reqID int64, at time.Time, req *http.Request) error {
+	return s.write(storageRecord{
+		Kind: "request", BidiKey: bidikey, ReqID: reqID, At: at,
+		Host: req.Host, Method: req.Method, Path: req.URL.Path,
+	})
+}
+
+// ReceivedResponse records resp as received on bidikey at at, matched to
+// its request by reqID.
+func (s *Storage) ReceivedResponse(bidikey uint64, reqID int64, at time.Time, resp *http.Response) error {
+	return s.write(storageRecord{
+		Kind: "response", BidiKey: bidikey, ReqID: reqID, At: at,
+		Status: resp.StatusCode,
+	})
+}
+
+// GRPCCallComplete records one finished gRPC call: the request/response
+// message counts and byte sizes gathered from the DATA frames on
+// streamID, the full method name read from :path, and the grpc-status/
+// grpc-message trailers the call closed with.
+func (s *Storage) GRPCCallComplete(bidikey uint64, streamID uint32, method string,
+	reqMessageCount int, reqByteSize int64, respMessageCount int, respByteSize int64,
+	status, message string) error {
+	return s.write(storageRecord{
+		Kind: "grpc_call", BidiKey: bidikey, StreamID: streamID, Path: method,
+		ReqMessageCount: reqMessageCount, ReqByteSize: reqByteSize,
+		RespMessageCount: respMessageCount, RespByteSize: respByteSize,
+		GRPCStatus: status, GRPCMessage: message,
+	})
+}
+
+// Close flushes and closes dbFile. It blocks until every record written
+// so far has reached disk.
+func (s *Storage) Close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.f.Sync()
+	s.f.Close()
+}
+
+// readStorageRecords reads back every record appended to dbFile, in
+// order, for Reporting to summarize.
+func readStorageRecords() ([]storageRecord, error) {
+	f, err := os.Open(*dbFile)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var records []storageRecord
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var rec storageRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			continue
+		}
+		records = append(records, rec)
+	}
+	return records, scanner.Err()
+}
@@ -0,0 +1,505 @@
+// Copyright 2014 Lieven Govaerts. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+	"hash"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+var keylogFile = flag.String("keylog", "", "NSS key log file (SSLKEYLOGFILE) used to decrypt captured TLS traffic")
+
+// tlsRecordHeaderLen is the length of a TLS record header: content type (1),
+// protocol version (2), length (2).
+const tlsRecordHeaderLen = 5
+
+const (
+	tlsContentTypeHandshake     = 22
+	tlsContentTypeAppData       = 23
+	tlsHandshakeTypeClientHello = 1
+	tlsHandshakeTypeServerHello = 2
+)
+
+// sslKeyLog watches an NSS key log file and answers lookups for the secrets
+// logged against a given TLS 1.3 client random. Browsers write to this file
+// asynchronously as the handshake progresses, so lookups poll until the
+// requested label shows up or a timeout elapses.
+type sslKeyLog struct {
+	mu      sync.Mutex
+	path    string
+	offset  int64
+	secrets map[string]map[string][]byte // client random (hex) -> label -> secret
+}
+
+// newSSLKeyLog opens path for polling; the file does not need to exist yet,
+// since browsers create it lazily on the first TLS connection.
+func newSSLKeyLog(path string) *sslKeyLog {
+	return &sslKeyLog{path: path, secrets: make(map[string]map[string][]byte)}
+}
+
+// poll reads any lines appended to the key log file since the last call and
+// merges the secrets they contain into k.secrets.
+func (k *sslKeyLog) poll() {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	f, err := os.Open(k.path)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	if _, err := f.Seek(k.offset, io.SeekStart); err != nil {
+		return
+	}
+
+	scanner := bufio.NewScanner(f)
+	var read int64
+	for scanner.Scan() {
+		line := scanner.Text()
+		read += int64(len(line)) + 1
+		fields := bytes.Fields([]byte(line))
+		if len(fields) != 3 {
+			continue
+		}
+		label := string(fields[0])
+		clientRandom := string(fields[1])
+		secret, err := hex.DecodeString(string(fields[2]))
+		if err != nil {
+			continue
+		}
+		if k.secrets[clientRandom] == nil {
+			k.secrets[clientRandom] = make(map[string][]byte)
+		}
+		k.secrets[clientRandom][label] = secret
+	}
+	k.offset += read
+}
+
+// lookup polls the key log file until label is available for clientRandom
+// or timeout elapses.
+func (k *sslKeyLog) lookup(clientRandom []byte, label string, timeout time.Duration) ([]byte, bool) {
+	deadline := time.Now().Add(timeout)
+	key := hex.EncodeToString(clientRandom)
+	for {
+		k.poll()
+		k.mu.Lock()
+		secret, ok := k.secrets[key][label]
+		k.mu.Unlock()
+		if ok {
+			return secret, true
+		}
+		if time.Now().After(deadline) {
+			return nil, false
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// hkdfExpandLabel implements the TLS 1.3 HKDF-Expand-Label function from
+// RFC 8446 §7.1, used to derive traffic keys, IVs and further secrets from a
+// traffic secret logged in the key log file. The hash must match the one
+// bound to the negotiated cipher suite (RFC 8446 §B.4): SHA-256 for every
+// suite trmon supports except TLS_AES_256_GCM_SHA384, which uses SHA-384.
+func hkdfExpandLabel(secret []byte, label string, context []byte, length int, newHash func() hash.Hash) []byte {
+	var hkdfLabel bytes.Buffer
+	binary.Write(&hkdfLabel, binary.BigEndian, uint16(length))
+	fullLabel := "tls13 " + label
+	hkdfLabel.WriteByte(byte(len(fullLabel)))
+	hkdfLabel.WriteString(fullLabel)
+	hkdfLabel.WriteByte(byte(len(context)))
+	hkdfLabel.Write(context)
+
+	out := make([]byte, length)
+	r := hkdf.Expand(newHash, secret, hkdfLabel.Bytes())
+	io.ReadFull(r, out)
+	return out
+}
+
+// cipherSuite describes how to derive traffic keys and build the AEAD for
+// one TLS 1.3 cipher suite, per RFC 8446 §B.4.
+type cipherSuite struct {
+	keyLen  int
+	newHash func() hash.Hash
+	newAEAD func(key []byte) (cipher.AEAD, error)
+}
+
+func newAESGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func newChaCha20Poly1305(key []byte) (cipher.AEAD, error) {
+	return chacha20poly1305.New(key)
+}
+
+// cipherSuites covers the TLS 1.3 suites in common use (RFC 8446 §B.4):
+// AES-128-GCM and ChaCha20-Poly1305 (both SHA-256), and AES-256-GCM
+// (SHA-384). TLS_AES_128_CCM_SHA256 and its 8-bit-tag variant are omitted;
+// no browser or major server enables them by default.
+var cipherSuites = map[uint16]cipherSuite{
+	0x1301: {16, sha256.New, newAESGCM},           // TLS_AES_128_GCM_SHA256
+	0x1302: {32, sha512.New384, newAESGCM},        // TLS_AES_256_GCM_SHA384
+	0x1303: {32, sha256.New, newChaCha20Poly1305}, // TLS_CHACHA20_POLY1305_SHA256
+}
+
+// trafficKeys holds the AEAD key and IV derived from a single TLS 1.3
+// traffic secret, per RFC 8446 §7.3.
+type trafficKeys struct {
+	aead cipher.AEAD
+	iv   []byte
+	seq  uint64
+}
+
+// open decrypts a single TLS 1.3 record under tk. aad must be the 5-byte
+// record header (type||legacy_record_version||length), which RFC 8446 §5.2
+// requires be authenticated as the AEAD's additional data. It also strips
+// the zero padding and the trailing inner content-type byte that TLS 1.3
+// record protection appends to the plaintext.
+//
+// The sequence number only advances once Open succeeds: a record that fails
+// to authenticate (a capture gap, a truncated segment, the handshake-peel
+// probe in readRecord) must not consume a sequence number, or every later
+// record in this direction would be tried against the wrong nonce.
+func (tk *trafficKeys) open(ciphertext, aad []byte) ([]byte, error) {
+	nonce := tk.nonce(tk.seq)
+	plain, err := tk.aead.Open(nil, nonce, ciphertext, aad)
+	if err != nil {
+		return nil, err
+	}
+	tk.seq++
+	for len(plain) > 0 && plain[len(plain)-1] == 0 {
+		plain = plain[:len(plain)-1]
+	}
+	if len(plain) == 0 {
+		return nil, errors.New("empty TLS 1.3 plaintext record")
+	}
+	return plain[:len(plain)-1], nil
+}
+
+func deriveTrafficKeys(secret []byte, suite cipherSuite) (*trafficKeys, error) {
+	key := hkdfExpandLabel(secret, "key", nil, suite.keyLen, suite.newHash)
+	iv := hkdfExpandLabel(secret, "iv", nil, 12, suite.newHash)
+
+	aead, err := suite.newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	return &trafficKeys{aead: aead, iv: iv}, nil
+}
+
+// nonce computes the record nonce for sequence number seq by XOR-ing the
+// fixed IV with it, per RFC 8446 §5.3.
+func (tk *trafficKeys) nonce(seq uint64) []byte {
+	n := make([]byte, len(tk.iv))
+	copy(n, tk.iv)
+	for i := 0; i < 8; i++ {
+		n[len(n)-1-i] ^= byte(seq >> (8 * uint(i)))
+	}
+	return n
+}
+
+// tlsDecrypter sits between the raw TCP reassembly reader and the HTTP
+// parser. It reads TLS records off of src, and once handshake secrets for
+// the connection appear in the key log file, decrypts application_data
+// records and hands the plaintext to Read callers. Records before the keys
+// are available, and the post-ServerHello handshake records (which are
+// themselves sent as application_data under the handshake traffic secret),
+// are consumed but discarded.
+//
+// Only the outbound (client->server) half ever sees the ClientHello, so a
+// server-direction decrypter has no clientRandom of its own; announceRandom
+// and randomSource let the two halves of a connection share it. The
+// negotiated cipher suite is the mirror image: only the inbound
+// (server->client) half ever sees the ServerHello that names it, so
+// announceCipherSuite and cipherSuiteSource share it the other way. See
+// TCPStream.decryptIfTLS.
+type tlsDecrypter struct {
+	src            io.Reader
+	keylog         *sslKeyLog
+	clientRandom   []byte
+	randomSource   <-chan []byte // server direction: receives the random the client direction parsed
+	announceRandom func([]byte)  // client direction: publishes the random once parsed from the ClientHello
+
+	cipherSuiteID       uint16
+	cipherSuiteSource   <-chan uint16 // client direction: receives the suite the server direction parsed
+	announceCipherSuite func(uint16)  // server direction: publishes the suite once parsed from the ServerHello
+	suite               *cipherSuite  // resolved and cached once cipherSuiteID is known
+	warnedUnsupported   bool
+
+	handshakeKeys *trafficKeys
+	appKeys       *trafficKeys
+	inAppData     bool // true once the encrypted handshake gives way to real application_data
+	isClient      bool // true for the client->server direction
+	pending       bytes.Buffer
+}
+
+func newTLSDecrypter(src io.Reader, keylog *sslKeyLog, isClient bool) *tlsDecrypter {
+	return &tlsDecrypter{src: src, keylog: keylog, isClient: isClient}
+}
+
+func (d *tlsDecrypter) Read(p []byte) (int, error) {
+	for d.pending.Len() == 0 {
+		if err := d.readRecord(); err != nil {
+			return 0, err
+		}
+	}
+	return d.pending.Read(p)
+}
+
+// readRecord reads and processes exactly one TLS record from d.src.
+func (d *tlsDecrypter) readRecord() error {
+	hdr := make([]byte, tlsRecordHeaderLen)
+	if _, err := io.ReadFull(d.src, hdr); err != nil {
+		return err
+	}
+	contentType := hdr[0]
+	length := int(binary.BigEndian.Uint16(hdr[3:5]))
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(d.src, payload); err != nil {
+		return err
+	}
+
+	switch contentType {
+	case tlsContentTypeHandshake:
+		if d.clientRandom == nil && d.isClient {
+			if random, ok := parseClientHelloRandom(payload); ok {
+				d.clientRandom = random
+				if d.announceRandom != nil {
+					d.announceRandom(random)
+				}
+			}
+		}
+		if d.cipherSuiteID == 0 && !d.isClient {
+			if id, ok := parseServerHelloCipherSuite(payload); ok {
+				d.cipherSuiteID = id
+				if d.announceCipherSuite != nil {
+					d.announceCipherSuite(id)
+				}
+			}
+		}
+		return nil
+	case tlsContentTypeAppData:
+		if !d.inAppData {
+			// TLS 1.3 sends EncryptedExtensions/Certificate/CertificateVerify/
+			// Finished as application_data records too, but under the
+			// handshake traffic secret rather than appKeys. Peel those off
+			// first; the first record that doesn't decrypt under the
+			// handshake secret is the first genuine app-data record, and
+			// appKeys.seq must start counting from exactly there.
+			if d.ensureHandshakeKeys() {
+				if _, err := d.handshakeKeys.open(payload, hdr); err == nil {
+					return nil
+				}
+			}
+			d.inAppData = true
+		}
+		if d.appKeys == nil {
+			if !d.ensureAppKeys() {
+				// Keys not (yet) available; drop the record rather than
+				// blocking the whole capture on one connection.
+				return nil
+			}
+		}
+		plain, err := d.appKeys.open(payload, hdr)
+		if err != nil {
+			return nil
+		}
+		d.pending.Write(plain)
+		return nil
+	default:
+		// ChangeCipherSpec, Alert, etc: nothing to decode.
+		return nil
+	}
+}
+
+// resolveClientRandom fills in clientRandom for a server-direction
+// decrypter, borrowing the value the client direction parsed out of the
+// ClientHello, since the ServerHello side never sees it directly.
+func (d *tlsDecrypter) resolveClientRandom() bool {
+	if d.clientRandom != nil {
+		return true
+	}
+	if d.randomSource == nil {
+		return false
+	}
+	select {
+	case random := <-d.randomSource:
+		d.clientRandom = random
+		return true
+	case <-time.After(2 * time.Second):
+		return false
+	}
+}
+
+// resolveCipherSuite fills in the negotiated cipher suite, borrowing it from
+// the server direction if this decrypter never saw a ServerHello itself,
+// and logs once (rather than failing silently) if the suite isn't one
+// trmon knows how to derive keys for.
+func (d *tlsDecrypter) resolveCipherSuite() (cipherSuite, bool) {
+	if d.suite != nil {
+		return *d.suite, true
+	}
+	if d.cipherSuiteID == 0 {
+		if d.cipherSuiteSource == nil {
+			return cipherSuite{}, false
+		}
+		select {
+		case id := <-d.cipherSuiteSource:
+			d.cipherSuiteID = id
+		case <-time.After(2 * time.Second):
+			return cipherSuite{}, false
+		}
+	}
+	suite, ok := cipherSuites[d.cipherSuiteID]
+	if !ok {
+		if !d.warnedUnsupported {
+			d.warnedUnsupported = true
+			log.Printf("tls: negotiated cipher suite 0x%04x is not supported, cannot decrypt this connection", d.cipherSuiteID)
+		}
+		return cipherSuite{}, false
+	}
+	d.suite = &suite
+	return suite, true
+}
+
+func (d *tlsDecrypter) ensureHandshakeKeys() bool {
+	if d.handshakeKeys != nil {
+		return true
+	}
+	if !d.resolveClientRandom() {
+		return false
+	}
+	suite, ok := d.resolveCipherSuite()
+	if !ok {
+		return false
+	}
+	label := "SERVER_HANDSHAKE_TRAFFIC_SECRET"
+	if d.isClient {
+		label = "CLIENT_HANDSHAKE_TRAFFIC_SECRET"
+	}
+	secret, ok := d.keylog.lookup(d.clientRandom, label, 2*time.Second)
+	if !ok {
+		return false
+	}
+	keys, err := deriveTrafficKeys(secret, suite)
+	if err != nil {
+		return false
+	}
+	d.handshakeKeys = keys
+	return true
+}
+
+func (d *tlsDecrypter) ensureAppKeys() bool {
+	if !d.resolveClientRandom() {
+		return false
+	}
+	suite, ok := d.resolveCipherSuite()
+	if !ok {
+		return false
+	}
+	label := "SERVER_TRAFFIC_SECRET_0"
+	if d.isClient {
+		label = "CLIENT_TRAFFIC_SECRET_0"
+	}
+	secret, ok := d.keylog.lookup(d.clientRandom, label, 2*time.Second)
+	if !ok {
+		return false
+	}
+	keys, err := deriveTrafficKeys(secret, suite)
+	if err != nil {
+		return false
+	}
+	d.appKeys = keys
+	return true
+}
+
+// parseClientHelloRandom extracts the 32-byte client random from a
+// ClientHello handshake message body.
+func parseClientHelloRandom(handshake []byte) ([]byte, bool) {
+	if len(handshake) < 4 || handshake[0] != tlsHandshakeTypeClientHello {
+		return nil, false
+	}
+	body := handshake[4:]
+	// legacy_version(2) + random(32)
+	if len(body) < 34 {
+		return nil, false
+	}
+	random := make([]byte, 32)
+	copy(random, body[2:34])
+	return random, true
+}
+
+// parseServerHelloCipherSuite extracts the negotiated cipher suite from a
+// ServerHello handshake message body.
+func parseServerHelloCipherSuite(handshake []byte) (uint16, bool) {
+	if len(handshake) < 4 || handshake[0] != tlsHandshakeTypeServerHello {
+		return 0, false
+	}
+	body := handshake[4:]
+	// legacy_version(2) + random(32) + legacy_session_id length(1)
+	if len(body) < 35 {
+		return 0, false
+	}
+	sessionIDLen := int(body[34])
+	offset := 35 + sessionIDLen
+	if len(body) < offset+2 {
+		return 0, false
+	}
+	return binary.BigEndian.Uint16(body[offset : offset+2]), true
+}
+
+// looksLikeTLSClientHello peeks at the front of buf and reports whether it
+// starts with a TLS handshake record containing a ClientHello.
+func looksLikeTLSClientHello(buf *bufio.Reader) bool {
+	hdr, err := buf.Peek(tlsRecordHeaderLen + 6)
+	if err != nil {
+		return false
+	}
+	return hdr[0] == tlsContentTypeHandshake && hdr[5] == tlsHandshakeTypeClientHello
+}
+
+// looksLikeTLSServerHello peeks at the front of buf and reports whether it
+// starts with a TLS handshake record containing a ServerHello. It is the
+// server-direction counterpart of looksLikeTLSClientHello: the response
+// half of a TLS 1.3 connection opens with a ServerHello, never a
+// ClientHello, so the two directions need separate sniffers.
+func looksLikeTLSServerHello(buf *bufio.Reader) bool {
+	hdr, err := buf.Peek(tlsRecordHeaderLen + 6)
+	if err != nil {
+		return false
+	}
+	return hdr[0] == tlsContentTypeHandshake && hdr[5] == tlsHandshakeTypeServerHello
+}